@@ -0,0 +1,409 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+
+	"github.com/nsec/askgod/internal/utils"
+)
+
+// watchDebounce is how long to coalesce bursts of filesystem events into a single reload
+const watchDebounce = 200 * time.Millisecond
+
+// confdDirName is the name of the optional overlay directory looked up next to the main config file
+const confdDirName = "conf.d"
+
+// httpSourcePollInterval is the default polling interval for an HTTPSource with none configured
+const httpSourcePollInterval = 30 * time.Second
+
+// Source is a place askgod can load part of its configuration from. Config merges the Read of
+// every configured Source in priority order and re-merges whenever any of them signals a change
+// on its Watch channel.
+type Source interface {
+	// Read returns the source's current content as yaml, or nil if it has nothing to contribute
+	Read() ([]byte, error)
+
+	// Watch returns a channel that receives a value whenever the source's content may have
+	// changed. It must stop any background work and close no later than ctx being cancelled.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// FileSource reads configuration from a YAML file, together with any *.yaml fragments found in
+// a conf.d directory next to it (merged on top, in lexical order)
+type FileSource struct {
+	// Path is the main configuration file to load
+	Path string
+}
+
+// Read implements Source
+func (f *FileSource) Read() ([]byte, error) {
+	merged := map[interface{}]interface{}{}
+
+	err := mergeYAMLFile(f.Path, merged)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := confdDir(f.Path)
+	if utils.PathExists(dir) {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list conf.d fragments: %v", err)
+		}
+
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			err := mergeYAMLFile(match, merged)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse conf.d fragment %s: %v", match, err)
+			}
+		}
+	}
+
+	return yaml.Marshal(merged)
+}
+
+// Watch implements Source
+func (f *FileSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	return watchFile(ctx, f.Path)
+}
+
+// mergeYAMLFile parses path and deep-merges it into dst, so a fragment that only sets
+// database.dsn doesn't clobber sibling keys such as database.driver set elsewhere
+func mergeYAMLFile(path string, dst map[interface{}]interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read file content: %v", err)
+	}
+
+	overlay := map[interface{}]interface{}{}
+	err = yaml.Unmarshal(content, &overlay)
+	if err != nil {
+		return fmt.Errorf("Failed to parse yaml: %v", err)
+	}
+
+	deepMergeMaps(dst, overlay)
+
+	return nil
+}
+
+// deepMergeMaps recursively merges src into dst: nested maps are merged key-by-key, anything
+// else (scalars, lists) is overwritten wholesale by the value from src
+func deepMergeMaps(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, ok := v.(map[interface{}]interface{})
+		if ok {
+			if dstMap, ok := dst[k].(map[interface{}]interface{}); ok {
+				deepMergeMaps(dstMap, srcMap)
+				continue
+			}
+		}
+
+		dst[k] = v
+	}
+}
+
+// confdDir returns the overlay directory for a given config file
+func confdDir(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), confdDirName)
+}
+
+// fileIdentity captures enough of a file's identity to notice an atomic replace (rename-and-swap
+// editors, `sed -i`, Kubernetes ConfigMap `..data` symlink swaps) even when the path doesn't change
+type fileIdentity struct {
+	inode uint64
+	mtime time.Time
+}
+
+func statIdentity(path string) fileIdentity {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileIdentity{}
+	}
+
+	var inode uint64
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = sys.Ino
+	}
+
+	return fileIdentity{inode: inode, mtime: info.ModTime()}
+}
+
+// watchFile watches the directory containing path (and its conf.d overlay, if present) and sends
+// on the returned channel, debounced, whenever path or the overlay may have changed: direct
+// writes, rename-and-replace edits (vim, sed -i), or ConfigMap "..data" symlink swaps.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to setup fsnotify: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("Unable to setup fsnotify watch: %v", err)
+	}
+
+	confd := confdDir(path)
+	if utils.PathExists(confd) {
+		err = watcher.Add(confd)
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("Unable to setup fsnotify watch: %v", err)
+		}
+	}
+
+	cleanPath := filepath.Clean(path)
+
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		resolvedPath = cleanPath
+	}
+
+	identity := statIdentity(path)
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer watcher.Close()
+		defer close(changes)
+
+		var debounce *time.Timer
+		reload := make(chan struct{}, 1)
+
+		scheduleReload := func() {
+			if debounce != nil {
+				debounce.Stop()
+			}
+
+			debounce = time.AfterFunc(watchDebounce, func() {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			})
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				changed := false
+
+				switch {
+				case filepath.Clean(ev.Name) == cleanPath:
+					// The config file itself was written to directly
+					changed = true
+				case strings.HasPrefix(ev.Name, confd+string(filepath.Separator)):
+					// A conf.d fragment was added, changed or removed
+					changed = true
+				case filepath.Dir(ev.Name) == dir && ev.Op&(fsnotify.Create|fsnotify.Rename) != 0:
+					// Possible rename-and-replace (vim, sed -i) or ConfigMap "..data" symlink
+					// swap: see whether the path now resolves to a different target
+					if newResolved, err := filepath.EvalSymlinks(path); err == nil && newResolved != resolvedPath {
+						resolvedPath = newResolved
+						changed = true
+					}
+				}
+
+				if !changed {
+					// Fall back to inode/mtime in case the rename wasn't otherwise recognized
+					if newIdentity := statIdentity(path); newIdentity != identity {
+						changed = true
+					}
+				}
+
+				if changed {
+					scheduleReload()
+				}
+			case <-reload:
+				identity = statIdentity(path)
+
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// SignalSource triggers a reload of the other configured sources whenever the process receives
+// SIGHUP. It never contributes any content of its own, which is useful when running in containers
+// where fsnotify is unreliable on bind-mounted files but a controller can still signal the process.
+type SignalSource struct{}
+
+// Read implements Source. SignalSource has no content of its own.
+func (s *SignalSource) Read() ([]byte, error) {
+	return nil, nil
+}
+
+// Watch implements Source
+func (s *SignalSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer signal.Stop(signals)
+		defer close(changes)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// HTTPSource periodically fetches configuration from a URL, using ETag/If-Modified-Since to
+// avoid re-parsing when the remote content hasn't changed
+type HTTPSource struct {
+	// URL is the address to fetch the configuration from
+	URL string
+
+	// Client is the HTTP client to use, defaulting to http.DefaultClient
+	Client *http.Client
+
+	// PollInterval is how often to check the URL for changes, defaulting to 30s
+	PollInterval time.Duration
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	cached       []byte
+}
+
+// Read implements Source
+func (h *HTTPSource) Read() ([]byte, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build request for %s: %v", h.URL, err)
+	}
+
+	h.mu.Lock()
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.lastModified != "" {
+		req.Header.Set("If-Modified-Since", h.lastModified)
+	}
+	h.mu.Unlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s: %v", h.URL, err)
+	}
+	defer resp.Body.Close()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return h.cached, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status fetching %s: %s", h.URL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response from %s: %v", h.URL, err)
+	}
+
+	h.etag = resp.Header.Get("ETag")
+	h.lastModified = resp.Header.Get("Last-Modified")
+	h.cached = body
+
+	return body, nil
+}
+
+// Watch implements Source
+func (h *HTTPSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	interval := h.PollInterval
+	if interval <= 0 {
+		interval = httpSourcePollInterval
+	}
+
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(changes)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.mu.Lock()
+				etag := h.etag
+				lastModified := h.lastModified
+				cached := h.cached
+				h.mu.Unlock()
+
+				_, err := h.Read()
+				if err != nil {
+					continue
+				}
+
+				// Compare the body too, so servers that send neither ETag nor Last-Modified
+				// still trigger a reload when their content changes
+				h.mu.Lock()
+				changed := h.etag != etag || h.lastModified != lastModified || !bytes.Equal(h.cached, cached)
+				h.mu.Unlock()
+
+				if changed {
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import "testing"
+
+func TestDeepMergeMapsPreservesSiblingKeys(t *testing.T) {
+	dst := map[interface{}]interface{}{
+		"database": map[interface{}]interface{}{
+			"driver": "postgres",
+			"dsn":    "base-dsn",
+		},
+		"logging": map[interface{}]interface{}{
+			"level": "info",
+		},
+	}
+
+	src := map[interface{}]interface{}{
+		"database": map[interface{}]interface{}{
+			"dsn": "overridden-dsn",
+		},
+	}
+
+	deepMergeMaps(dst, src)
+
+	database, ok := dst["database"].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("expected database to remain a map, got %T", dst["database"])
+	}
+
+	if database["driver"] != "postgres" {
+		t.Errorf("expected database.driver to be preserved, got %v", database["driver"])
+	}
+
+	if database["dsn"] != "overridden-dsn" {
+		t.Errorf("expected database.dsn to be overridden, got %v", database["dsn"])
+	}
+
+	logging, ok := dst["logging"].(map[interface{}]interface{})
+	if !ok || logging["level"] != "info" {
+		t.Errorf("expected unrelated sections to be untouched, got %v", dst["logging"])
+	}
+}
+
+func TestDeepMergeMapsOverwritesScalarsAndLists(t *testing.T) {
+	dst := map[interface{}]interface{}{
+		"level": "old",
+		"tags":  []interface{}{"a", "b"},
+	}
+
+	src := map[interface{}]interface{}{
+		"level": "new",
+		"tags":  []interface{}{"c"},
+	}
+
+	deepMergeMaps(dst, src)
+
+	if dst["level"] != "new" {
+		t.Errorf("expected scalar to be overwritten, got %v", dst["level"])
+	}
+
+	tags, ok := dst["tags"].([]interface{})
+	if !ok || len(tags) != 1 || tags[0] != "c" {
+		t.Errorf("expected list to be overwritten wholesale, got %v", dst["tags"])
+	}
+}
+
+func TestDeepMergeMapsAddsNewKeys(t *testing.T) {
+	dst := map[interface{}]interface{}{
+		"database": map[interface{}]interface{}{
+			"driver": "postgres",
+		},
+	}
+
+	src := map[interface{}]interface{}{
+		"http": map[interface{}]interface{}{
+			"address": ":8080",
+		},
+	}
+
+	deepMergeMaps(dst, src)
+
+	if _, ok := dst["database"]; !ok {
+		t.Errorf("expected existing keys to survive a merge that only adds new ones")
+	}
+
+	http, ok := dst["http"].(map[interface{}]interface{})
+	if !ok || http["address"] != ":8080" {
+		t.Errorf("expected http.address to be added, got %v", dst["http"])
+	}
+}
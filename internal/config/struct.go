@@ -1,12 +1,14 @@
 package config
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"path/filepath"
-	"time"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/lxc/lxd/shared/log15"
 	"gopkg.in/yaml.v2"
 
@@ -14,105 +16,385 @@ import (
 	"github.com/nsec/askgod/internal/utils"
 )
 
+// envPrefix is prepended to the yaml tag path when looking up environment overrides
+const envPrefix = "ASKGOD"
+
 // Config represents the internal view of the configuration
 type Config struct {
 	*api.Config
-	logger   log15.Logger
-	handlers []func(*Config)
+	logger       log15.Logger
+	sources      []Source
+	handlers     []func(*Config, *ConfigDiff)
+	pathHandlers []pathHandler
+	errHandlers  []func(*Config) error
+
+	cancel  context.CancelFunc
+	watchWG sync.WaitGroup
+
+	// reloadMu serializes reload() end-to-end: Config has one watch goroutine per source, and
+	// without this two sources firing close together would each build a candidate from the same
+	// stale previous, race to swap it in, and run the handlers twice
+	reloadMu sync.Mutex
+
+	// mu guards the embedded *api.Config pointer itself (swapped wholesale on a successful
+	// reload) as well as version and lastErr, which always change alongside it
+	mu      sync.RWMutex
+	version uint64
+	lastErr error
 }
 
-// RegisterHandler makes it possible to register a function to be called on config changes
-func (c *Config) RegisterHandler(handler func(*Config)) error {
-	c.handlers = append(c.handlers, handler)
-	return nil
+// Version returns a counter that increments every time a reload has been successfully applied
+func (c *Config) Version() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.version
 }
 
-func parseConfig(configPath string, conf interface{}) error {
-	// Read the file's content
-	content, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return fmt.Errorf("Failed to read file content: %v", err)
+// LastReloadError returns the error from the most recent reload attempt, or nil if it succeeded
+// (or none has happened yet)
+func (c *Config) LastReloadError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lastErr
+}
+
+func (c *Config) setLastReloadError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+}
+
+// Close stops any background configuration watch and releases its resources
+func (c *Config) Close() error {
+	if c.cancel == nil {
+		return nil
 	}
 
-	// Parse the yaml file
-	err = yaml.Unmarshal(content, conf)
-	if err != nil {
-		return fmt.Errorf("Failed to parse yaml: %v", err)
+	c.cancel()
+	c.watchWG.Wait()
+
+	return nil
+}
+
+// ConfigDiff describes which top-level sections of api.Config changed between two reloads
+type ConfigDiff struct {
+	Changed []string
+}
+
+// Contains reports whether the named top-level section (e.g. "Database", "Logging") changed
+func (d *ConfigDiff) Contains(path string) bool {
+	for _, changed := range d.Changed {
+		if changed == path {
+			return true
+		}
 	}
 
+	return false
+}
+
+type pathHandler struct {
+	path    string
+	handler func(*Config)
+}
+
+// RegisterHandler makes it possible to register a function to be called on every config change,
+// along with a ConfigDiff describing which top-level sections actually changed
+func (c *Config) RegisterHandler(handler func(*Config, *ConfigDiff)) error {
+	c.handlers = append(c.handlers, handler)
 	return nil
 }
 
-// ReadConfigFile will return a Config struct from the content of a yaml file
-func ReadConfigFile(configPath string, monitor bool, logger log15.Logger) (*Config, error) {
-	if !utils.PathExists(configPath) {
-		return nil, fmt.Errorf("The configuration file doesn't exist: %s", configPath)
+// RegisterHandlerFor registers a function that's only called when the named top-level section
+// (e.g. "Database", "Logging") changed, avoiding unnecessary rebuilds on unrelated reloads
+func (c *Config) RegisterHandlerFor(path string, handler func(*Config)) error {
+	c.pathHandlers = append(c.pathHandlers, pathHandler{path: path, handler: handler})
+	return nil
+}
+
+// RegisterHandlerE registers a function that can reject an incoming reload by returning an error.
+// If it does, the whole reload is rolled back: the previous config stays live, the error is
+// exposed via LastReloadError, and no RegisterHandler or RegisterHandlerFor handler sees the
+// rejected config. RegisterHandlerE handlers registered before the rejecting one have already
+// been called with it.
+func (c *Config) RegisterHandlerE(handler func(*Config) error) error {
+	c.errHandlers = append(c.errHandlers, handler)
+	return nil
+}
+
+// diffConfig compares the top-level fields of two api.Config values and reports which ones differ
+func diffConfig(oldConf *api.Config, newConf *api.Config) *ConfigDiff {
+	diff := &ConfigDiff{}
+
+	ov := reflect.ValueOf(oldConf).Elem()
+	nv := reflect.ValueOf(newConf).Elem()
+	t := ov.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		oldData, _ := yaml.Marshal(ov.Field(i).Interface())
+		newData, _ := yaml.Marshal(nv.Field(i).Interface())
+		if string(oldData) != string(newData) {
+			diff.Changed = append(diff.Changed, t.Field(i).Name)
+		}
 	}
 
-	logger.Info("Parsing configuration", log15.Ctx{"path": configPath})
+	return diff
+}
 
-	conf := Config{logger: logger}
-	err := parseConfig(configPath, &conf.Config)
-	if err != nil {
-		return nil, err
+// applyEnvOverrides walks conf's fields and overrides any of them for which a matching
+// ASKGOD_<SECTION>_<FIELD> environment variable (derived from the yaml tags) is set
+func applyEnvOverrides(conf interface{}) error {
+	return applyEnvOverridesStruct(reflect.ValueOf(conf).Elem(), envPrefix)
+}
+
+func applyEnvOverridesStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			name = strings.ToLower(field.Name)
+		}
+
+		envName := fmt.Sprintf("%s_%s", prefix, strings.ToUpper(name))
+
+		switch value.Kind() {
+		case reflect.Struct:
+			err := applyEnvOverridesStruct(value, envName)
+			if err != nil {
+				return err
+			}
+		case reflect.Ptr:
+			if value.IsNil() {
+				continue
+			}
+
+			err := applyEnvOverridesStruct(value.Elem(), envName)
+			if err != nil {
+				return err
+			}
+		default:
+			raw, ok := os.LookupEnv(envName)
+			if !ok {
+				continue
+			}
+
+			err := setFieldFromEnv(value, raw)
+			if err != nil {
+				return fmt.Errorf("Failed to apply %s: %v", envName, err)
+			}
+		}
 	}
 
-	// Watch for configuration changes
-	if monitor {
-		logger.Info("Setting up configuration watch", log15.Ctx{"path": configPath})
+	return nil
+}
 
-		watcher, err := fsnotify.NewWatcher()
+func setFieldFromEnv(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to setup fsnotify: %v", err)
+			return err
 		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type: %s", field.Kind())
+	}
 
-		err = watcher.Add(filepath.Dir(configPath))
+	return nil
+}
+
+// mergeSources reads every configured source in priority order and merges the result into
+// target, then applies environment variable overrides on top
+func (c *Config) mergeSources(target *api.Config) error {
+	for _, src := range c.sources {
+		data, err := src.Read()
 		if err != nil {
-			return nil, fmt.Errorf("Unable to setup fsnotify watch: %v", err)
+			return fmt.Errorf("Failed to read configuration source: %v", err)
 		}
 
-		pathDir := filepath.Dir(configPath)
-		if pathDir == "" {
-			pathDir = "./"
+		if len(data) == 0 {
+			continue
 		}
-		pathBase := filepath.Base(configPath)
 
-		go func() {
-			for {
-				select {
-				case ev := <-watcher.Events:
-					if ev.Name != fmt.Sprintf("%s/%s", pathDir, pathBase) {
-						continue
-					}
+		err = yaml.Unmarshal(data, target)
+		if err != nil {
+			return fmt.Errorf("Failed to parse yaml: %v", err)
+		}
+	}
 
-					// Store the old config for comparison
-					oldData, _ := yaml.Marshal(conf.Config)
+	return applyEnvOverrides(target)
+}
 
-					// Wait for 1s for ownership changes
-					time.Sleep(time.Second)
+// watchSources starts a goroutine per source that re-merges all sources and dispatches the
+// registered handlers whenever that source signals a change
+func (c *Config) watchSources() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
 
-					// Parse the new ocnfig
-					err := parseConfig(configPath, conf.Config)
-					if err != nil {
-						logger.Error("Failed to read the new configuration", log15.Ctx{"path": configPath, "error": err})
-					}
+	for _, src := range c.sources {
+		changes, err := src.Watch(ctx)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("Unable to watch configuration source: %v", err)
+		}
 
-					// Check if something changed
-					newData, _ := yaml.Marshal(conf.Config)
-					if string(oldData) == string(newData) {
-						continue
-					}
+		c.watchWG.Add(1)
+		go func(changes <-chan struct{}) {
+			defer c.watchWG.Done()
 
-					logger.Info("Configuration file changed, reloading", log15.Ctx{"path": configPath})
-					for _, handler := range conf.handlers {
-						handler(&conf)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-changes:
+					if !ok {
+						return
 					}
-				case err := <-watcher.Errors:
-					logger.Error("Got bad file notification", log15.Ctx{"error": err})
+
+					c.reload()
 				}
 			}
-		}()
+		}(changes)
+	}
+
+	return nil
+}
+
+// liveConfig returns the currently live *api.Config, synchronized against concurrent reloads
+func (c *Config) liveConfig() *api.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.Config
+}
+
+// reload rebuilds a candidate config from scratch by re-reading every configured source (so a
+// key removed from the file, or a deleted conf.d fragment, actually disappears instead of
+// lingering from the previous snapshot), validates it against the schema and lets any
+// RegisterHandlerE handler vet it, all without touching the live config or the previous snapshot.
+// Only once the candidate has cleared every check is it swapped in - atomically, alongside the
+// version bump - so a reader can never observe a rejected or half-applied reload. Any failure -
+// to read, to validate, or a handler rejecting the change - leaves the previously live config
+// untouched and is recorded so it can be retrieved with LastReloadError. reload is never run
+// concurrently with itself: reloadMu serializes the whole body across the per-source watch
+// goroutines so two reloads can't race to build a candidate off the same stale previous.
+func (c *Config) reload() {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	previous := c.liveConfig()
+	candidate := &api.Config{}
+
+	err := c.mergeSources(candidate)
+	if err != nil {
+		c.logger.Error("Failed to reload the configuration", log15.Ctx{"error": err})
+		c.setLastReloadError(err)
+		return
+	}
+
+	err = validateConfig(candidate)
+	if err != nil {
+		c.logger.Error("Rejected new configuration", log15.Ctx{"error": err})
+		c.setLastReloadError(err)
+		return
+	}
+
+	diff := diffConfig(previous, candidate)
+	if len(diff.Changed) == 0 {
+		c.setLastReloadError(nil)
+		return
+	}
+
+	// Let RegisterHandlerE handlers vet the candidate on a throwaway Config wrapping it, so a
+	// rejection never makes the live config observable in a to-be-rolled-back state
+	trial := &Config{Config: candidate, logger: c.logger, sources: c.sources}
+	for _, handler := range c.errHandlers {
+		err := handler(trial)
+		if err != nil {
+			err = fmt.Errorf("Handler rejected the new configuration: %v", err)
+			c.logger.Error("Rejected new configuration", log15.Ctx{"error": err})
+			c.setLastReloadError(err)
+			return
+		}
+	}
+
+	c.logger.Info("Configuration changed, reloading", log15.Ctx{"changed": diff.Changed})
+
+	c.mu.Lock()
+	c.Config = candidate
+	c.version++
+	c.lastErr = nil
+	c.mu.Unlock()
+
+	for _, handler := range c.handlers {
+		handler(c, diff)
+	}
+
+	for _, ph := range c.pathHandlers {
+		if diff.Contains(ph.path) {
+			ph.handler(c)
+		}
+	}
+}
+
+// NewConfig builds a Config from one or more Source, in priority order (later sources win on
+// conflicting keys), optionally watching all of them for changes
+func NewConfig(sources []Source, monitor bool, logger log15.Logger) (*Config, error) {
+	conf := &Config{
+		Config:  &api.Config{},
+		logger:  logger,
+		sources: sources,
+	}
+
+	err := conf.mergeSources(conf.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateConfig(conf.Config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
 	}
 
-	return &conf, nil
+	conf.version = 1
+
+	if monitor {
+		err := conf.watchSources()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return conf, nil
+}
+
+// ReadConfigFile will return a Config struct from the content of a yaml file
+func ReadConfigFile(configPath string, monitor bool, logger log15.Logger) (*Config, error) {
+	if !utils.PathExists(configPath) {
+		return nil, fmt.Errorf("The configuration file doesn't exist: %s", configPath)
+	}
+
+	logger.Info("Parsing configuration", log15.Ctx{"path": configPath})
+
+	return NewConfig([]Source{&FileSource{Path: configPath}}, monitor, logger)
 }
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lxc/lxd/shared/log15"
+
+	"github.com/nsec/askgod/api"
+)
+
+func TestDiffConfigReportsChangedSections(t *testing.T) {
+	oldConf := &api.Config{}
+	oldConf.Database.Driver = "postgres"
+	oldConf.Logging.Level = "info"
+
+	newConf := &api.Config{}
+	newConf.Database.Driver = "mysql"
+	newConf.Logging.Level = "info"
+
+	diff := diffConfig(oldConf, newConf)
+
+	if !diff.Contains("Database") {
+		t.Errorf("expected Database to be reported as changed")
+	}
+
+	if diff.Contains("Logging") {
+		t.Errorf("did not expect Logging to be reported as changed")
+	}
+}
+
+func TestDiffConfigNoChanges(t *testing.T) {
+	oldConf := &api.Config{}
+	newConf := &api.Config{}
+
+	diff := diffConfig(oldConf, newConf)
+	if len(diff.Changed) != 0 {
+		t.Errorf("expected no sections to be reported as changed, got %v", diff.Changed)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	conf := &api.Config{}
+	t.Setenv("ASKGOD_DATABASE_DRIVER", "postgres")
+	t.Setenv("ASKGOD_LOGGING_LEVEL", "debug")
+
+	err := applyEnvOverrides(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if conf.Database.Driver != "postgres" {
+		t.Errorf("expected database.driver to be overridden, got %q", conf.Database.Driver)
+	}
+
+	if conf.Logging.Level != "debug" {
+		t.Errorf("expected logging.level to be overridden, got %q", conf.Logging.Level)
+	}
+}
+
+func TestApplyEnvOverridesInvalidValue(t *testing.T) {
+	conf := &api.Config{}
+	t.Setenv("ASKGOD_SCORING_ENABLED", "not-a-bool")
+
+	err := applyEnvOverrides(conf)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid bool override")
+	}
+}
+
+// stubSource is a Source with content the test can mutate between reloads, and a Watch that
+// never fires on its own (the test drives reload() directly).
+type stubSource struct {
+	data []byte
+}
+
+func (s *stubSource) Read() ([]byte, error) {
+	return s.data, nil
+}
+
+func (s *stubSource) Watch(ctx context.Context) (<-chan struct{}, error) {
+	return make(chan struct{}), nil
+}
+
+func TestReloadRollbackOnInvalidConfig(t *testing.T) {
+	src := &stubSource{data: []byte("database:\n  driver: postgres\n  dsn: postgres://localhost/db\n")}
+
+	conf, err := NewConfig([]Source{src}, false, log15.New())
+	if err != nil {
+		t.Fatalf("unexpected error building config: %v", err)
+	}
+
+	previous := conf.Config
+
+	src.data = []byte("database:\n  driver: postgres\n")
+	conf.reload()
+
+	if conf.Config != previous {
+		t.Errorf("expected the live config to be left untouched after a rejected reload")
+	}
+
+	if conf.LastReloadError() == nil {
+		t.Errorf("expected LastReloadError to be set after a rejected reload")
+	}
+
+	if conf.Version() != 1 {
+		t.Errorf("expected version to remain at 1 after a rejected reload, got %d", conf.Version())
+	}
+}
+
+func TestReloadRollbackOnHandlerRejection(t *testing.T) {
+	src := &stubSource{data: []byte("database:\n  driver: postgres\n  dsn: postgres://localhost/db\n")}
+
+	conf, err := NewConfig([]Source{src}, false, log15.New())
+	if err != nil {
+		t.Fatalf("unexpected error building config: %v", err)
+	}
+
+	previous := conf.Config
+
+	rejectErr := errors.New("nope")
+	conf.RegisterHandlerE(func(*Config) error { return rejectErr })
+
+	src.data = []byte("database:\n  driver: mysql\n  dsn: postgres://localhost/db\n")
+	conf.reload()
+
+	if conf.Config != previous {
+		t.Errorf("expected the live config to be left untouched after a handler-rejected reload")
+	}
+
+	if conf.Config.Database.Driver != "postgres" {
+		t.Errorf("expected the previous config's fields to be unmodified, got driver %q", conf.Config.Database.Driver)
+	}
+
+	if conf.Version() != 1 {
+		t.Errorf("expected version to remain at 1 after a rejected reload, got %d", conf.Version())
+	}
+}
+
+func TestReloadAppliesValidChange(t *testing.T) {
+	src := &stubSource{data: []byte("database:\n  driver: postgres\n  dsn: postgres://localhost/db\n")}
+
+	conf, err := NewConfig([]Source{src}, false, log15.New())
+	if err != nil {
+		t.Fatalf("unexpected error building config: %v", err)
+	}
+
+	src.data = []byte("database:\n  driver: mysql\n  dsn: postgres://localhost/db\n")
+	conf.reload()
+
+	if conf.Config.Database.Driver != "mysql" {
+		t.Errorf("expected the new driver to be applied, got %q", conf.Config.Database.Driver)
+	}
+
+	if conf.Version() != 2 {
+		t.Errorf("expected version to be bumped to 2, got %d", conf.Version())
+	}
+
+	if conf.LastReloadError() != nil {
+		t.Errorf("expected no reload error, got %v", conf.LastReloadError())
+	}
+}
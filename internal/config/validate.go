@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nsec/askgod/api"
+)
+
+// validationErrors aggregates every schema violation found while validating a candidate config,
+// so a reload failure can be logged (and returned from LastReloadError) with full detail
+type validationErrors []error
+
+func (e validationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// validateConfig checks a candidate api.Config against askgod's schema, returning every
+// violation found. Currently that's required fields, a DB DSN parse check and a logging level
+// enum; value ranges and mutually exclusive options will follow once api.Config grows fields
+// that actually need them.
+func validateConfig(conf *api.Config) error {
+	var errs validationErrors
+
+	if conf.Database.Driver == "" {
+		errs = append(errs, fmt.Errorf("database.driver: required field is empty"))
+	}
+
+	if conf.Database.DSN == "" {
+		errs = append(errs, fmt.Errorf("database.dsn: required field is empty"))
+	} else if strings.Contains(conf.Database.DSN, "://") {
+		// Only DSNs that look like a URL (e.g. postgres://...) can be validated this way;
+		// other drivers (e.g. mysql's user:pass@tcp(host)/db) use an opaque format
+		if _, err := url.Parse(conf.Database.DSN); err != nil {
+			errs = append(errs, fmt.Errorf("database.dsn: %v", err))
+		}
+	}
+
+	switch conf.Logging.Level {
+	case "", "debug", "info", "warn", "error", "crit":
+	default:
+		errs = append(errs, fmt.Errorf("logging.level: unknown level %q", conf.Logging.Level))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
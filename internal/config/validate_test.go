@@ -0,0 +1,67 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/nsec/askgod/api"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		conf    api.Config
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			conf: api.Config{
+				Database: api.DatabaseConfig{Driver: "postgres", DSN: "postgres://localhost/db"},
+				Logging:  api.LoggingConfig{Level: "info"},
+			},
+		},
+		{
+			name:    "missing driver",
+			conf:    api.Config{Database: api.DatabaseConfig{DSN: "postgres://localhost/db"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing dsn",
+			conf:    api.Config{Database: api.DatabaseConfig{Driver: "postgres"}},
+			wantErr: true,
+		},
+		{
+			name:    "malformed url dsn",
+			conf:    api.Config{Database: api.DatabaseConfig{Driver: "postgres", DSN: "postgres://%zz"}},
+			wantErr: true,
+		},
+		{
+			name: "opaque dsn is not url-checked",
+			conf: api.Config{
+				Database: api.DatabaseConfig{Driver: "mysql", DSN: "user:pass@tcp(localhost)/db"},
+			},
+		},
+		{
+			name: "unknown log level",
+			conf: api.Config{
+				Database: api.DatabaseConfig{Driver: "postgres", DSN: "postgres://localhost/db"},
+				Logging:  api.LoggingConfig{Level: "noisy"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := tc.conf
+			err := validateConfig(&conf)
+
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}